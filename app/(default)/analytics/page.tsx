@@ -1,6 +1,6 @@
 "use client";
 
-import { useState, useEffect } from "react";
+import { useState, useEffect, FormEvent } from "react";
 import { useRouter } from "next/navigation";
 
 interface AnalyticsData {
@@ -27,15 +27,34 @@ export default function AnalyticsPage() {
   const [data, setData] = useState<AnalyticsData | null>(null);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState<string | null>(null);
+  const [apiKey, setApiKey] = useState<string | null>(null);
+  const [keyInput, setKeyInput] = useState('');
   const router = useRouter();
 
-  const fetchAnalytics = async () => {
+  const fetchAnalytics = async (key: string | null = apiKey) => {
+    if (!key) {
+      setLoading(false);
+      return;
+    }
+
     try {
       setLoading(true);
       const response = await fetch('/api/analytics', {
         method: 'GET',
+        headers: {
+          'Authorization': `Bearer ${key}`,
+        },
       });
 
+      if (response.status === 401 || response.status === 403) {
+        // The key was rejected: forget it and ask the operator again
+        sessionStorage.removeItem('analyticsApiKey');
+        setApiKey(null);
+        setData(null);
+        setError(response.status === 401 ? 'Invalid API key' : 'This API key cannot read analytics');
+        return;
+      }
+
       if (!response.ok) {
         throw new Error(`HTTP error! status: ${response.status}`);
       }
@@ -52,11 +71,32 @@ export default function AnalyticsPage() {
   };
 
   useEffect(() => {
+    // Operators keep their key for the browser session only
+    const storedKey = sessionStorage.getItem('analyticsApiKey');
+    setApiKey(storedKey);
+    if (!storedKey) {
+      setLoading(false);
+    }
+  }, []);
+
+  useEffect(() => {
+    if (!apiKey) return;
+
     // Initial fetch and auto-refresh every 30 seconds
-    fetchAnalytics();
-    const interval = setInterval(fetchAnalytics, 30000);
+    fetchAnalytics(apiKey);
+    const interval = setInterval(() => fetchAnalytics(apiKey), 30000);
     return () => clearInterval(interval);
-  }, []);
+  }, [apiKey]);
+
+  const submitKey = (e: FormEvent) => {
+    e.preventDefault();
+    const key = keyInput.trim();
+    if (!key) return;
+    sessionStorage.setItem('analyticsApiKey', key);
+    setKeyInput('');
+    setError(null);
+    setApiKey(key);
+  };
 
   const formatUptime = (seconds: number) => {
     const hours = Math.floor(seconds / 3600);
@@ -80,13 +120,39 @@ export default function AnalyticsPage() {
     );
   }
 
+  if (!apiKey) {
+    return (
+      <section className="relative min-h-screen flex items-center justify-center">
+        <form onSubmit={submitKey} className="w-full max-w-sm text-center">
+          <h1 className="text-2xl font-bold text-gray-200 mb-2">Analytics Dashboard</h1>
+          <p className="text-gray-400 mb-4">Enter an API key with the read-analytics scope.</p>
+          {error && <div className="text-red-400 mb-4">⚠️ {error}</div>}
+          <input
+            type="password"
+            value={keyInput}
+            onChange={(e) => setKeyInput(e.target.value)}
+            placeholder="API key"
+            autoComplete="off"
+            className="form-input w-full mb-4"
+          />
+          <button
+            type="submit"
+            className="btn w-full bg-linear-to-t from-brown-600 to-brown-500 bg-[length:100%_100%] bg-[bottom] text-white shadow-[inset_0px_1px_0px_0px_--theme(--color-white/.16)] hover:bg-[length:100%_150%]"
+          >
+            View Analytics
+          </button>
+        </form>
+      </section>
+    );
+  }
+
   if (error) {
     return (
       <section className="relative min-h-screen flex items-center justify-center">
         <div className="text-center">
           <div className="text-red-400 mb-4">⚠️ {error}</div>
           <button
-            onClick={fetchAnalytics}
+            onClick={() => fetchAnalytics()}
             className="btn bg-linear-to-t from-brown-600 to-brown-500 bg-[length:100%_100%] bg-[bottom] text-white shadow-[inset_0px_1px_0px_0px_--theme(--color-white/.16)] hover:bg-[length:100%_150%]"
           >
             Retry
@@ -109,7 +175,7 @@ export default function AnalyticsPage() {
           </div>
           <div className="flex gap-4">
             <button
-              onClick={fetchAnalytics}
+              onClick={() => fetchAnalytics()}
               disabled={loading}
               className="btn-sm bg-linear-to-t from-brown-600 to-brown-500 bg-[length:100%_100%] bg-[bottom] text-white shadow-[inset_0px_1px_0px_0px_--theme(--color-white/.16)] hover:bg-[length:100%_150%] disabled:opacity-50"
             >
@@ -3,15 +3,32 @@ import { NextRequest, NextResponse } from 'next/server';
 const GO_BACKEND_URL = process.env.GO_BACKEND_URL || 'http://localhost:8080';
 
 export async function GET(request: NextRequest) {
+  // Analytics are for operators only: forward the caller's own API key and never add one here
+  const authHeader = request.headers.get('authorization');
+  if (!authHeader) {
+    return NextResponse.json(
+      { error: 'Unauthorized' },
+      { status: 401 }
+    );
+  }
+
   try {
     // Fetch analytics data from Go backend
     const response = await fetch(`${GO_BACKEND_URL}/backend/analytics`, {
       method: 'GET',
       headers: {
         'Content-Type': 'application/json',
+        'Authorization': authHeader,
       },
     });
 
+    if (response.status === 401 || response.status === 403) {
+      return NextResponse.json(
+        { error: response.status === 401 ? 'Unauthorized' : 'Forbidden' },
+        { status: response.status }
+      );
+    }
+
     if (!response.ok) {
       throw new Error(`Go backend responded with status: ${response.status}`);
     }
@@ -31,9 +31,8 @@ export async function POST(request: NextRequest) {
     }
 
     const userAgent = request.headers.get('user-agent') || '';
-    const xForwardedFor = request.headers.get('x-forwarded-for') || '';
-    const clientIP = xForwardedFor.split(',')[0] || 'unknown';
-    const userID = `${clientIP}-${Date.now()}`;
+    // An opaque ID; the backend keeps its hash, so it must not be derived from the client IP
+    const userID = crypto.randomUUID();
 
     const response = await fetch(`${GO_BACKEND_URL}/backend/roast`, {
       method: 'POST',
@@ -0,0 +1,1547 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// useTestAnalytics swaps in a throwaway analytics manager for one test
+func useTestAnalytics(t *testing.T) *AnalyticsManager {
+	t.Helper()
+	previous := analyticsManager
+	config := NewAnalyticsPersistenceConfig()
+	analyticsManager = NewAnalyticsManager(NewJSONFileStore(filepath.Join(t.TempDir(), "analytics.json"), config), config)
+	t.Cleanup(func() {
+		analyticsManager.Close()
+		analyticsManager = previous
+	})
+	return analyticsManager
+}
+
+func TestScoringRubricValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(r *ScoringRubric)
+		wantErr string
+	}{
+		{name: "built-in rubric is valid", change: func(r *ScoringRubric) {}},
+		{name: "no factors", change: func(r *ScoringRubric) { r.Factors = nil }, wantErr: "at least one factor"},
+		{name: "blank factor name", change: func(r *ScoringRubric) { r.Factors[0].Name = " " }, wantErr: "name cannot be empty"},
+		{name: "duplicate factor", change: func(r *ScoringRubric) { r.Factors[1].Name = r.Factors[0].Name }, wantErr: "duplicate"},
+		{name: "zero weight", change: func(r *ScoringRubric) { r.Factors[0].Weight = 0 }, wantErr: "positive weight"},
+		{name: "weights short of 100", change: func(r *ScoringRubric) { r.Factors[0].Weight-- }, wantErr: "sum to 100, got 99"},
+		{name: "no bands", change: func(r *ScoringRubric) { r.Bands = nil }, wantErr: "at least one score band"},
+		{name: "gap between bands", change: func(r *ScoringRubric) { r.Bands[1].Min++ }, wantErr: "starts at 22, expected 21"},
+		{name: "overlapping bands", change: func(r *ScoringRubric) { r.Bands[0].Max++ }, wantErr: "starts at 21, expected 22"},
+		{name: "first band above zero", change: func(r *ScoringRubric) { r.Bands[0].Min = 1 }, wantErr: "expected 0"},
+		{name: "band max below min", change: func(r *ScoringRubric) { r.Bands[4].Max = 80 }, wantErr: "below min"},
+		{name: "last band short of 100", change: func(r *ScoringRubric) { r.Bands[4].Max = 99 }, wantErr: "must end at 100"},
+		{name: "unlabelled band", change: func(r *ScoringRubric) { r.Bands[2].Label = "" }, wantErr: "must have a label"},
+		{name: "fallback score out of range", change: func(r *ScoringRubric) { r.FallbackScore = 101 }, wantErr: "between 0 and 100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rubric := defaultScoringRubric()
+			tt.change(rubric)
+			err := rubric.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestScoringRubricBandFor(t *testing.T) {
+	rubric := defaultScoringRubric()
+
+	// Every score from 0 to 100 lands in exactly the band whose range holds it
+	for score := 0; score <= 100; score++ {
+		band := rubric.BandFor(score)
+		if band == nil {
+			t.Fatalf("BandFor(%d) = nil", score)
+		}
+		if score < band.Min || score > band.Max {
+			t.Errorf("BandFor(%d) = %q (%d-%d)", score, band.Label, band.Min, band.Max)
+		}
+	}
+
+	if got := rubric.BandFor(20).Label; got != "Extremely risky" {
+		t.Errorf("BandFor(20) = %q, want the top of the first band", got)
+	}
+	if got := rubric.BandFor(21).Label; got != "High risk" {
+		t.Errorf("BandFor(21) = %q, want the bottom of the second band", got)
+	}
+	for _, score := range []int{-1, 101} {
+		if band := rubric.BandFor(score); band != nil {
+			t.Errorf("BandFor(%d) = %q, want nil", score, band.Label)
+		}
+	}
+}
+
+func TestShippedRubricMatchesBuiltIn(t *testing.T) {
+	rubric, err := LoadScoringRubric("config/rubric.json")
+	if err != nil {
+		t.Fatalf("LoadScoringRubric: %v", err)
+	}
+	if !reflect.DeepEqual(rubric, defaultScoringRubric()) {
+		t.Errorf("config/rubric.json differs from the built-in rubric:\n%+v", rubric)
+	}
+}
+
+func TestAggregateScoreSamples(t *testing.T) {
+	tests := []struct {
+		name           string
+		scores         []int
+		wantScore      int
+		wantSpread     int
+		wantConfidence float64
+	}{
+		{name: "single sample", scores: []int{47}, wantScore: 47, wantSpread: 0, wantConfidence: 1},
+		{name: "odd count takes the middle", scores: []int{70, 40, 55}, wantScore: 55, wantSpread: 30, wantConfidence: 0.7},
+		{name: "even count averages the middle two", scores: []int{40, 50, 60, 90}, wantScore: 55, wantSpread: 50, wantConfidence: 0.5},
+		{name: "even count rounds half up", scores: []int{40, 41}, wantScore: 41, wantSpread: 1, wantConfidence: 0.99},
+		{name: "outlier doesn't move the median", scores: []int{52, 0, 53, 51, 52}, wantScore: 52, wantSpread: 53, wantConfidence: 0.47},
+		{name: "full range", scores: []int{0, 100}, wantScore: 50, wantSpread: 100, wantConfidence: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := append([]int(nil), tt.scores...)
+			result := aggregateScoreSamples(tt.scores)
+			if result.Score != tt.wantScore || result.Spread != tt.wantSpread {
+				t.Errorf("score %d spread %d, want %d spread %d", result.Score, result.Spread, tt.wantScore, tt.wantSpread)
+			}
+			if math.Abs(result.Confidence-tt.wantConfidence) > 1e-9 {
+				t.Errorf("confidence %v, want %v", result.Confidence, tt.wantConfidence)
+			}
+			if !reflect.DeepEqual(result.Samples, original) || !reflect.DeepEqual(tt.scores, original) {
+				t.Errorf("samples %v, want them in request order %v", result.Samples, original)
+			}
+		})
+	}
+}
+
+func TestPortfolioSeedIgnoresOrder(t *testing.T) {
+	a := portfolioSeed([]string{"TCS", "INFY", "RELIANCE"})
+	b := portfolioSeed([]string{"RELIANCE", "TCS", "INFY"})
+	if a != b {
+		t.Errorf("seeds differ by ticker order: %d and %d", a, b)
+	}
+	if a < 0 {
+		t.Errorf("seed %d is negative", a)
+	}
+	if c := portfolioSeed([]string{"TCS", "INFY"}); c == a {
+		t.Errorf("a different ticker set got the same seed %d", c)
+	}
+}
+
+func TestNewScoreSamplingConfig(t *testing.T) {
+	tests := []struct {
+		samples, temperature, seeded string
+		want                         ScoreSamplingConfig
+	}{
+		{want: ScoreSamplingConfig{Samples: 1, Temperature: 0.2, Seeded: true}},
+		{samples: "5", temperature: "0.7", seeded: "false", want: ScoreSamplingConfig{Samples: 5, Temperature: 0.7}},
+		{samples: "12", want: ScoreSamplingConfig{Samples: 1, Temperature: 0.2, Seeded: true}},
+		{samples: "0", temperature: "3", seeded: "0", want: ScoreSamplingConfig{Samples: 1, Temperature: 0.2}},
+		{samples: "three", temperature: "-1", seeded: "yes", want: ScoreSamplingConfig{Samples: 1, Temperature: 0.2, Seeded: true}},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("SCORE_SAMPLES", tt.samples)
+		t.Setenv("SCORE_TEMPERATURE", tt.temperature)
+		t.Setenv("SCORE_SEEDED", tt.seeded)
+		if got := NewScoreSamplingConfig(); *got != tt.want {
+			t.Errorf("SCORE_SAMPLES=%q SCORE_TEMPERATURE=%q SCORE_SEEDED=%q: got %+v, want %+v", tt.samples, tt.temperature, tt.seeded, *got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	catalog := &LanguageCatalog{
+		DefaultLanguage: "en",
+		Languages: []*Language{
+			{Code: "en", Aliases: []string{"en-in", "en-us"}},
+			{Code: "hi", Aliases: []string{"hi-IN"}},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		lang           string
+		acceptLanguage string
+		want           string
+		wantErr        bool
+	}{
+		{name: "nothing sent uses the default", want: "en"},
+		{name: "explicit lang wins over header", lang: "hi", acceptLanguage: "en-US", want: "hi"},
+		{name: "explicit alias is case-insensitive", lang: " HI-in ", want: "hi"},
+		{name: "unsupported explicit lang is an error", lang: "fr", acceptLanguage: "hi", wantErr: true},
+		{name: "exact header match", acceptLanguage: "hi", want: "hi"},
+		{name: "alias header match", acceptLanguage: "hi-IN", want: "hi"},
+		{name: "region falls back to primary subtag", acceptLanguage: "hi-Deva-IN", want: "hi"},
+		{name: "highest q wins regardless of order", acceptLanguage: "en;q=0.5, hi;q=0.9", want: "hi"},
+		{name: "equal q keeps header order", acceptLanguage: "hi, en", want: "hi"},
+		{name: "unsupported tags are skipped", acceptLanguage: "fr-FR, de;q=0.9, hi;q=0.1", want: "hi"},
+		{name: "q=0 excludes a language", acceptLanguage: "hi;q=0, fr", want: "en"},
+		{name: "wildcard is ignored", acceptLanguage: "*, hi;q=0.2", want: "hi"},
+		{name: "malformed q counts as 1", acceptLanguage: "en;q=0.5, hi;q=abc", want: "hi"},
+		{name: "empty entries are ignored", acceptLanguage: ",, ;q=1, hi", want: "hi"},
+		{name: "no supported tag uses the default", acceptLanguage: "fr, de", want: "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			language, err := catalog.Negotiate(tt.lang, tt.acceptLanguage)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Negotiate(%q, %q) = %q, want an error", tt.lang, tt.acceptLanguage, language.Code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Negotiate(%q, %q) returned error: %v", tt.lang, tt.acceptLanguage, err)
+			}
+			if language.Code != tt.want {
+				t.Errorf("Negotiate(%q, %q) = %q, want %q", tt.lang, tt.acceptLanguage, language.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestExperimentAssign(t *testing.T) {
+	config := &ExperimentConfig{Experiments: []*Experiment{
+		{Name: "retired", Assignment: "user", Variants: []ExperimentVariant{{Name: "control", Weight: 100}, {Name: "old", Weight: 0}}},
+		{Name: "roast-length", Enabled: true, Assignment: "user", Variants: []ExperimentVariant{
+			{Name: "control", Weight: 70},
+			{Name: "never", Weight: 0},
+			{Name: "concise", Weight: 30},
+		}},
+	}}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		userID := fmt.Sprintf("user-%d", i)
+		assignment := config.Assign(userID)
+		if assignment == nil || assignment.Experiment != "roast-length" {
+			t.Fatalf("Assign(%q) = %+v, want the enabled experiment", userID, assignment)
+		}
+		if again := config.Assign(userID); *again != *assignment {
+			t.Fatalf("Assign(%q) changed from %q to %q", userID, assignment.Variant, again.Variant)
+		}
+		counts[assignment.Variant]++
+	}
+
+	if counts["never"] != 0 {
+		t.Errorf("zero-weight variant was assigned %d times", counts["never"])
+	}
+	// 10000 users split 70/30; the hash should land within a couple of percent
+	if share := float64(counts["concise"]) / 10000; math.Abs(share-0.3) > 0.02 {
+		t.Errorf("concise got %.1f%% of users, want about 30%%", share*100)
+	}
+
+	// Without a user ID the bucket is random, but still only from the enabled experiment
+	if assignment := config.Assign(""); assignment == nil || assignment.Variant == "never" {
+		t.Errorf("Assign(\"\") = %+v", assignment)
+	}
+
+	config.Experiments[1].Enabled = false
+	if assignment := config.Assign("user-1"); assignment != nil {
+		t.Errorf("Assign with no enabled experiment = %+v, want nil", assignment)
+	}
+}
+
+func TestFeedbackStoreConsume(t *testing.T) {
+	store := &FeedbackStore{roasts: make(map[string]*servedRoast), ttl: time.Hour, maxRoasts: 2}
+	concise := &ExperimentAssignment{Experiment: "roast-length", Variant: "concise"}
+
+	store.Record("no-experiment", nil)
+	if _, err := store.Consume("no-experiment", "", ""); err != errUnknownRoast {
+		t.Errorf("roast served outside an experiment: err = %v, want errUnknownRoast", err)
+	}
+
+	store.Record("a", concise)
+	if _, err := store.Consume("a", "roast-length", "control"); err != errVariantMismatch {
+		t.Fatalf("wrong variant: err = %v, want errVariantMismatch", err)
+	}
+	// A mismatch doesn't use up the rating
+	got, err := store.Consume("a", "roast-length", "concise")
+	if err != nil || got != concise {
+		t.Fatalf("Consume = %+v, %v, want the serving assignment", got, err)
+	}
+	if _, err := store.Consume("a", "", ""); err != errUnknownRoast {
+		t.Errorf("second rating: err = %v, want errUnknownRoast", err)
+	}
+
+	// A full store evicts the oldest roast
+	store.Record("b", concise)
+	store.roasts["b"].servedAt = time.Now().Add(-time.Minute)
+	store.Record("c", concise)
+	store.Record("d", concise)
+	if _, err := store.Consume("b", "", ""); err != errUnknownRoast {
+		t.Errorf("oldest roast was kept past maxRoasts: err = %v", err)
+	}
+	if _, err := store.Consume("c", "", ""); err != nil {
+		t.Errorf("newer roast was evicted: %v", err)
+	}
+
+	store.roasts["d"].servedAt = time.Now().Add(-2 * time.Hour)
+	if _, err := store.Consume("d", "", ""); err != errUnknownRoast {
+		t.Errorf("expired roast: err = %v, want errUnknownRoast", err)
+	}
+}
+
+func TestOutputRuleValidate(t *testing.T) {
+	rule := &OutputRule{
+		Text: &FieldRule{Required: true, MinWords: 3, MaxWords: 5},
+		Fields: map[string]FieldRule{
+			"company": {Required: true},
+			"pros":    {Required: true, MinItems: 1, MaxItems: 2, MaxWords: 3},
+		},
+		Range: &RangeRule{Min: 0, Max: 100},
+	}
+
+	t.Run("text", func(t *testing.T) {
+		for text, want := range map[string][]string{
+			"a perfectly sized roast":     nil,
+			"   ":                         {"response must not be empty"},
+			"too short":                   {"response has 2 words, needs at least 3"},
+			"one two three four five six": {"response has 6 words, must be at most 5"},
+		} {
+			if got := rule.ValidateText(text); !reflect.DeepEqual(got, want) {
+				t.Errorf("ValidateText(%q) = %q, want %q", text, got, want)
+			}
+		}
+	})
+
+	t.Run("stock", func(t *testing.T) {
+		stock := &Stock{Company: "Tata Consultancy Services", Pros: []string{"steady dividends"}, Cons: nil}
+		if got := rule.ValidateStock(stock); got != nil {
+			t.Errorf("valid stock: %q", got)
+		}
+
+		stock = &Stock{Pros: []string{"good", "", "far too many words here"}}
+		want := []string{
+			"company must not be empty",
+			"pros has 3 items, must have at most 2",
+			"pros item 2 must not be empty",
+			"pros item 3 has 5 words, must be at most 3",
+		}
+		if got := rule.ValidateStock(stock); !reflect.DeepEqual(got, want) {
+			t.Errorf("ValidateStock = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("score", func(t *testing.T) {
+		if got := rule.ValidateScore(100); got != nil {
+			t.Errorf("ValidateScore(100) = %q", got)
+		}
+		if got := rule.ValidateScore(101); len(got) != 1 {
+			t.Errorf("ValidateScore(101) = %q, want one violation", got)
+		}
+	})
+
+	t.Run("no rule", func(t *testing.T) {
+		var none *OutputRule
+		if none.ValidateText("") != nil || none.ValidateStock(&Stock{}) != nil || none.ValidateScore(-5) != nil {
+			t.Error("a missing rule reported violations")
+		}
+	})
+}
+
+func TestPromptSetRule(t *testing.T) {
+	base := &OutputRule{Text: &FieldRule{MaxWords: 200}}
+	concise := &OutputRule{Text: &FieldRule{MaxWords: 100}}
+	ps := &PromptSet{
+		templates: map[string]*template.Template{
+			"roast":         template.New("roast"),
+			"roast@concise": template.New("roast@concise"),
+			"stock":         template.New("stock"),
+			"stock@concise": template.New("stock@concise"),
+		},
+		Rules: map[string]*OutputRule{
+			"roast":         base,
+			"roast@concise": concise,
+			"stock":         base,
+		},
+	}
+
+	tests := []struct {
+		name, template, variant string
+		want                    *OutputRule
+	}{
+		{name: "no variant", template: "roast", want: base},
+		{name: "control uses the base rule", template: "roast", variant: controlVariant, want: base},
+		{name: "variant with its own rule", template: "roast", variant: "concise", want: concise},
+		{name: "variant without a template override", template: "roast", variant: "verbose", want: base},
+		{name: "variant override without a rule falls back to the base", template: "stock", variant: "concise", want: base},
+		{name: "template without a rule", template: "score", want: nil},
+	}
+	for _, tt := range tests {
+		if got := ps.Rule(tt.template, tt.variant); got != tt.want {
+			t.Errorf("%s: Rule(%q, %q) = %+v, want %+v", tt.name, tt.template, tt.variant, got, tt.want)
+		}
+	}
+}
+
+func TestModerateText(t *testing.T) {
+	useTestAnalytics(t)
+	m, err := NewModerator("config/moderation.json")
+	if err != nil {
+		t.Fatalf("NewModerator: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		text       string
+		wantAction ModerationAction
+		wantText   string
+	}{
+		{name: "clean roast", text: "Your portfolio is a museum of 2021 hype.", wantAction: ModerationNone},
+		{name: "blocklist term", text: "What a retarded allocation.", wantAction: ModerationRegenerate},
+		{name: "blocklist is case-insensitive", text: "HARAMI move, beta.", wantAction: ModerationRegenerate},
+		{name: "blocklist matches whole words only", text: "The parandi index is down.", wantAction: ModerationNone},
+		{name: "blocklist in Devanagari", text: "ये पोर्टफोलियो हरामी है।", wantAction: ModerationRegenerate},
+		{name: "Devanagari terms match whole words only", text: "हरामीपन तो देखो।", wantAction: ModerationNone},
+		{name: "recommendation", text: "You should definitely sell before Friday.", wantAction: ModerationRegenerate},
+		{name: "price target", text: "My price target is the moon.", wantAction: ModerationRegenerate},
+		{name: "contact details are redacted", text: "Call 9876543210 or write to uncle@example.com today.", wantAction: ModerationRedact,
+			wantText: "Call [redacted] or write to [redacted] today."},
+		{name: "strongest action wins and redaction still applies", text: "Buy TCS now, then call 9876543210.", wantAction: ModerationRegenerate,
+			wantText: "Buy TCS now, then call [redacted]."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := tt.text
+			if got := m.ModerateText(&text); got != tt.wantAction {
+				t.Errorf("action = %v, want %v", got, tt.wantAction)
+			}
+			want := tt.wantText
+			if want == "" {
+				want = tt.text
+			}
+			if text != want {
+				t.Errorf("text = %q, want %q", text, want)
+			}
+		})
+	}
+}
+
+func TestModeratorDisabled(t *testing.T) {
+	useTestAnalytics(t)
+	m := &Moderator{config: &ModerationConfig{}}
+	text := "Call 9876543210, you should sell."
+	if got := m.ModerateText(&text); got != ModerationNone {
+		t.Errorf("disabled moderator returned %v", got)
+	}
+}
+
+func TestNewModeratorRejectsBadRules(t *testing.T) {
+	for name, config := range map[string]string{
+		"unnamed rule":     `{"rules": [{"terms": ["x"], "action": "redact"}]}`,
+		"unknown action":   `{"rules": [{"name": "r", "terms": ["x"], "action": "delete"}]}`,
+		"invalid pattern":  `{"rules": [{"name": "r", "patterns": ["("], "action": "redact"}]}`,
+		"nothing to match": `{"rules": [{"name": "r", "action": "redact"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "moderation.json")
+		os.WriteFile(path, []byte(config), 0644)
+		if _, err := NewModerator(path); err == nil {
+			t.Errorf("%s: NewModerator accepted %s", name, config)
+		}
+	}
+}
+
+func TestLoadGuardrailConfig(t *testing.T) {
+	if _, err := LoadGuardrailConfig("config/guardrails.json"); err != nil {
+		t.Fatalf("shipped config: %v", err)
+	}
+
+	config, err := LoadGuardrailConfig(filepath.Join(t.TempDir(), "missing.json"))
+	if err != nil {
+		t.Fatalf("missing config: %v", err)
+	}
+	if config.DailyCalls != 0 || config.DailyTokens != 0 || config.DailySpendUSD != 0 {
+		t.Errorf("missing config should leave usage uncapped, got %+v", config)
+	}
+
+	for _, bad := range []string{
+		`{"dailyCalls": -1}`,
+		`{"thresholds": {"preferCache": 0, "singleCall": 0.5, "fallbackOnly": 1}}`,
+		`{"thresholds": {"preferCache": 0.9, "singleCall": 0.5, "fallbackOnly": 1}}`,
+		`{"thresholds": {"preferCache": 0.5, "singleCall": 0.9, "fallbackOnly": 1.2}}`,
+		`{"thresholds": {"preferCache": 0.5, "singleCall": 0.9, "cacheOnly": 0.8, "fallbackOnly": 1}}`,
+		`{"dailyCalls": "lots"}`,
+	} {
+		path := filepath.Join(t.TempDir(), "guardrails.json")
+		os.WriteFile(path, []byte(bad), 0644)
+		if _, err := LoadGuardrailConfig(path); err == nil {
+			t.Errorf("LoadGuardrailConfig accepted %s", bad)
+		}
+	}
+}
+
+func TestGuardrailsStepDown(t *testing.T) {
+	am := useTestAnalytics(t)
+	g := NewGuardrails(&GuardrailConfig{
+		DailyCalls: 100,
+		Thresholds: GuardrailThresholds{PreferCache: 0.6, SingleCall: 0.75, CacheOnly: 0.9, FallbackOnly: 1},
+	})
+
+	// Each step spends calls up to the given total and expects the mode there
+	calls := int64(0)
+	for _, step := range []struct {
+		calls int64
+		want  GuardrailMode
+	}{
+		{0, GuardrailNormal},
+		{59, GuardrailNormal},
+		{60, GuardrailPreferCache},
+		{75, GuardrailSingleCall},
+		{90, GuardrailCacheOnly},
+		{99, GuardrailCacheOnly},
+		{100, GuardrailFallbackOnly},
+		{150, GuardrailFallbackOnly},
+	} {
+		am.TrackTokenUsage("key-1", "roast", TokenUsage{Calls: step.calls - calls})
+		calls = step.calls
+		if got := g.Mode(); got != step.want {
+			t.Errorf("at %d of 100 calls: mode = %s, want %s", calls, got, step.want)
+		}
+	}
+}
+
+func TestGuardrailsUseTheTightestCap(t *testing.T) {
+	am := useTestAnalytics(t)
+	g := NewGuardrails(&GuardrailConfig{
+		DailyCalls:    1000,
+		DailySpendUSD: 1,
+		Thresholds:    GuardrailThresholds{PreferCache: 0.6, SingleCall: 0.75, CacheOnly: 0.9, FallbackOnly: 1},
+	})
+
+	am.TrackTokenUsage("key-1", "roast", TokenUsage{Calls: 10, TotalTokens: 5000, EstimatedCostUSD: 0.8})
+	state := g.State()
+	if state.Mode != GuardrailSingleCall.String() {
+		t.Errorf("mode = %s, want %s", state.Mode, GuardrailSingleCall)
+	}
+	if math.Abs(state.Utilization-0.8) > 1e-9 {
+		t.Errorf("utilization = %v, want the spend ratio 0.8", state.Utilization)
+	}
+	if state.Calls != 10 || state.SpendUSD != 0.8 {
+		t.Errorf("state = %+v, want today's usage", state)
+	}
+}
+
+func writeEventBatches(t *testing.T, dir string, maxBytes int64, batches [][]int64) *EventLog {
+	t.Helper()
+	eventLog := NewEventLog(dir, maxBytes, 10)
+	for _, batch := range batches {
+		events := make([]AnalyticsEvent, len(batch))
+		for i, seq := range batch {
+			events[i] = AnalyticsEvent{Seq: seq, Type: eventPageVisit, UserHash: uint64(seq % 3)}
+		}
+		if err := eventLog.Append(events); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	return eventLog
+}
+
+// replaySeqs returns the sequence numbers Replay applies after seq
+func replaySeqs(t *testing.T, eventLog *EventLog, seq int64) []int64 {
+	t.Helper()
+	var seqs []int64
+	n, err := eventLog.Replay(seq, func(e AnalyticsEvent) { seqs = append(seqs, e.Seq) })
+	if err != nil {
+		t.Fatalf("Replay(%d): %v", seq, err)
+	}
+	if n != len(seqs) {
+		t.Fatalf("Replay(%d) reported %d events, applied %d", seq, n, len(seqs))
+	}
+	return seqs
+}
+
+func TestEventLogReplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		batches  [][]int64
+		trailer  string // written to the current file after the batches
+		after    int64
+		want     []int64
+	}{
+		{name: "everything from zero", maxBytes: 1 << 20, batches: [][]int64{{1, 2, 3}}, want: []int64{1, 2, 3}},
+		{name: "only events after seq", maxBytes: 1 << 20, batches: [][]int64{{1, 2, 3, 4}}, after: 2, want: []int64{3, 4}},
+		{name: "nothing after the last seq", maxBytes: 1 << 20, batches: [][]int64{{1, 2}}, after: 2},
+		{name: "empty log", maxBytes: 1 << 20},
+		{name: "across rotated files", maxBytes: 1, batches: [][]int64{{1, 2}, {3, 4}, {5}}, want: []int64{1, 2, 3, 4, 5}},
+		{name: "skips rotated files before seq", maxBytes: 1, batches: [][]int64{{1, 2}, {3, 4}, {5}}, after: 3, want: []int64{4, 5}},
+		{name: "rotated files then current file", maxBytes: 100, batches: [][]int64{{1, 2}, {3}}, after: 1, want: []int64{2, 3}},
+		{name: "duplicates already applied are skipped", maxBytes: 1 << 20, batches: [][]int64{{1, 2}, {2, 3}}, want: []int64{1, 2, 3}},
+		{name: "truncated last line", maxBytes: 1 << 20, batches: [][]int64{{1, 2}}, trailer: `{"seq":3,"ty`, want: []int64{1, 2}},
+		{name: "malformed line in the middle", maxBytes: 1 << 20, batches: [][]int64{{1}}, trailer: "not json\n{\"seq\":2}\n", want: []int64{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			eventLog := writeEventBatches(t, dir, tt.maxBytes, tt.batches)
+			defer eventLog.Close()
+			if tt.trailer != "" {
+				f, err := os.OpenFile(filepath.Join(dir, currentEventLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.WriteString(tt.trailer)
+				f.Close()
+			}
+
+			if got := replaySeqs(t, eventLog, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Replay(%d) = %v, want %v", tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventLogPrune(t *testing.T) {
+	dir := t.TempDir()
+	eventLog := NewEventLog(dir, 1, 2)
+	defer eventLog.Close()
+	for seq := int64(1); seq <= 5; seq++ {
+		if err := eventLog.Append([]AnalyticsEvent{{Seq: seq, Type: eventPageVisit}}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	// Files past the snapshot are never pruned, even beyond keep
+	eventLog.Prune(2)
+	if files, _ := eventLog.rotatedFiles(); len(files) != 3 {
+		t.Fatalf("after Prune(2), %d rotated files remain, want 3", len(files))
+	}
+	if got := replaySeqs(t, eventLog, 2); !reflect.DeepEqual(got, []int64{3, 4, 5}) {
+		t.Errorf("after Prune(2), Replay(2) = %v, want [3 4 5]", got)
+	}
+
+	eventLog.Prune(5)
+	_, lastSeqs := eventLog.rotatedFiles()
+	if !reflect.DeepEqual(lastSeqs, []int64{4, 5}) {
+		t.Errorf("after Prune(5), rotated files end at %v, want [4 5]", lastSeqs)
+	}
+}
+
+// testStores opens each analytics store implementation in a temp dir
+var testStores = map[string]func(t *testing.T) AnalyticsStore{
+	"json": func(t *testing.T) AnalyticsStore {
+		return NewJSONFileStore(filepath.Join(t.TempDir(), "analytics.json"), NewAnalyticsPersistenceConfig())
+	},
+	"sqlite": func(t *testing.T) AnalyticsStore {
+		store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "analytics.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		return store
+	},
+}
+
+// storeTestEvents has one event of each projected type, at a fixed UTC time so they compare equal after a round trip
+func storeTestEvents() []AnalyticsEvent {
+	at := time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)
+	return []AnalyticsEvent{
+		{Seq: 1, Time: at, Type: eventAPIRequest, Endpoint: "/roast", Success: true},
+		{Seq: 2, Time: at, Type: eventKeyUsage, KeyIndex: 1, KeyName: "key-2"},
+		{Seq: 3, Time: at, Type: eventTokenUsage, KeyName: "key-2", Endpoint: "roast",
+			Usage: &TokenUsage{Calls: 1, PromptTokens: 900, CandidateTokens: 300, TotalTokens: 1200, EstimatedCostUSD: 0.0004}},
+		{Seq: 4, Time: at.Add(time.Second), Type: eventRoast, Endpoint: "/roast", LatencyMs: 4200, Reasons: []string{"score"}},
+		{Seq: 5, Time: at.Add(time.Second), Type: eventPageVisit},
+	}
+}
+
+func TestAnalyticsStoreRoundTrip(t *testing.T) {
+	for name, open := range testStores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+
+			if snapshot, err := store.LoadSnapshot(); err != nil || snapshot != nil {
+				t.Fatalf("empty store: LoadSnapshot = %q, %v", snapshot, err)
+			}
+
+			events := storeTestEvents()
+			if err := store.Append(events[:3]); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			if err := store.Append(events[3:]); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+
+			var replayed []AnalyticsEvent
+			n, err := store.Replay(0, func(e AnalyticsEvent) { replayed = append(replayed, e) })
+			if err != nil || n != len(events) {
+				t.Fatalf("Replay(0) = %d, %v, want %d events", n, err, len(events))
+			}
+			if !reflect.DeepEqual(replayed, events) {
+				t.Errorf("Replay(0) = %+v, want %+v", replayed, events)
+			}
+
+			snapshot := []byte(`{"apiMetrics":{"totalRequests":1}}`)
+			if err := store.SaveSnapshot(snapshot, 3); err != nil {
+				t.Fatalf("SaveSnapshot: %v", err)
+			}
+			if got, err := store.LoadSnapshot(); err != nil || string(got) != string(snapshot) {
+				t.Errorf("LoadSnapshot = %q, %v, want %q", got, err, snapshot)
+			}
+
+			var seqs []int64
+			store.Replay(3, func(e AnalyticsEvent) { seqs = append(seqs, e.Seq) })
+			if !reflect.DeepEqual(seqs, []int64{4, 5}) {
+				t.Errorf("after the snapshot, Replay(3) = %v, want [4 5]", seqs)
+			}
+		})
+	}
+}
+
+func TestSQLiteStoreKeepsProjections(t *testing.T) {
+	store := testStores["sqlite"](t).(*SQLiteStore)
+	defer store.Close()
+
+	if err := store.Append(storeTestEvents()); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	// The snapshot drops the raw events but the query tables keep their history
+	if err := store.SaveSnapshot([]byte(`{}`), 5); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	// Numbering resumes past the stored seqs even once the raw events are gone
+	if seq, err := store.LastSeq(); err != nil || seq != 5 {
+		t.Errorf("LastSeq = %d, %v, want 5", seq, err)
+	}
+
+	for query, want := range map[string]string{
+		`SELECT COUNT(*) FROM events`:                                                 "0",
+		`SELECT endpoint || ':' || success FROM requests`:                             "/roast:1",
+		`SELECT key_index || ':' || key_name FROM key_usage`:                          "1:key-2",
+		`SELECT total_tokens || ':' || cost_usd FROM token_usage`:                     "1200:0.0004",
+		`SELECT latency_ms || ':' || degraded || ':' || fallback_reasons FROM roasts`: "4200:1:score",
+		`SELECT time FROM roasts`:                                                     "2026-03-14T09:30:01.000Z",
+	} {
+		var got string
+		if err := store.db.QueryRow(query).Scan(&got); err != nil {
+			t.Errorf("%s: %v", query, err)
+		} else if got != want {
+			t.Errorf("%s = %q, want %q", query, got, want)
+		}
+	}
+}
+
+// setReportingLocation switches the reporting timezone for one test
+func setReportingLocation(t *testing.T, name string) {
+	t.Helper()
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := reportingLocation
+	reportingLocation = location
+	t.Cleanup(func() { reportingLocation = previous })
+}
+
+func TestBucketRingRotation(t *testing.T) {
+	setReportingLocation(t, "UTC")
+	t0 := time.Date(2025, 7, 7, 10, 0, 0, 0, time.UTC)
+
+	type add struct {
+		minutes int // offset from t0
+		success bool
+	}
+	tests := []struct {
+		name         string
+		adds         []add
+		now          int // minutes after t0
+		n            int
+		wantRequests []int64
+		wantErrors   []int64
+	}{
+		{
+			name:         "same minute accumulates",
+			adds:         []add{{0, true}, {0, false}, {0, true}},
+			now:          0,
+			n:            1,
+			wantRequests: []int64{3},
+			wantErrors:   []int64{1},
+		},
+		{
+			name:         "gaps are empty buckets, oldest first",
+			adds:         []add{{0, true}, {2, false}},
+			now:          3,
+			n:            4,
+			wantRequests: []int64{1, 0, 1, 0},
+			wantErrors:   []int64{0, 0, 1, 0},
+		},
+		{
+			name:         "wrapping around resets the stale slot",
+			adds:         []add{{0, true}, {0, true}, {4, false}},
+			now:          4,
+			n:            4,
+			wantRequests: []int64{0, 0, 0, 1},
+			wantErrors:   []int64{0, 0, 0, 1},
+		},
+		{
+			name:         "adds older than the ring are dropped",
+			adds:         []add{{4, true}, {0, true}},
+			now:          4,
+			n:            4,
+			wantRequests: []int64{0, 0, 0, 1},
+			wantErrors:   []int64{0, 0, 0, 0},
+		},
+		{
+			name:         "stale slots read as empty without a new add",
+			adds:         []add{{0, true}, {1, true}},
+			now:          5,
+			n:            4,
+			wantRequests: []int64{0, 0, 0, 0},
+			wantErrors:   []int64{0, 0, 0, 0},
+		},
+		{
+			name:         "n is capped at the ring size",
+			adds:         []add{{1, true}, {2, true}, {3, true}, {4, true}},
+			now:          4,
+			n:            10,
+			wantRequests: []int64{1, 1, 1, 1},
+			wantErrors:   []int64{0, 0, 0, 0},
+		},
+		{
+			name:         "seconds within a minute share a bucket",
+			adds:         []add{{1, true}},
+			now:          1,
+			n:            2,
+			wantRequests: []int64{0, 1},
+			wantErrors:   []int64{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewBucketRing(time.Minute, 4)
+			for _, a := range tt.adds {
+				ring.Add(t0.Add(time.Duration(a.minutes)*time.Minute+30*time.Second), a.success)
+			}
+
+			now := t0.Add(time.Duration(tt.now)*time.Minute + 59*time.Second)
+			series := ring.Series(now, tt.n)
+			if len(series) != len(tt.wantRequests) {
+				t.Fatalf("Series returned %d buckets, want %d", len(series), len(tt.wantRequests))
+			}
+			var total int64
+			for i, bucket := range series {
+				wantStart := t0.Add(time.Duration(tt.now-len(series)+1+i) * time.Minute)
+				if !bucket.Start.Equal(wantStart) {
+					t.Errorf("bucket %d starts at %v, want %v", i, bucket.Start, wantStart)
+				}
+				if bucket.Requests != tt.wantRequests[i] || bucket.Errors != tt.wantErrors[i] {
+					t.Errorf("bucket %d = %d requests, %d errors, want %d, %d", i, bucket.Requests, bucket.Errors, tt.wantRequests[i], tt.wantErrors[i])
+				}
+				total += tt.wantRequests[i]
+			}
+			if got := ring.Requests(now, tt.n); got != total {
+				t.Errorf("Requests = %d, want %d", got, total)
+			}
+		})
+	}
+}
+
+func TestBucketRingLocalHours(t *testing.T) {
+	// IST is UTC+5:30, so local hours start at half past the UTC hour
+	setReportingLocation(t, "Asia/Kolkata")
+	ring := NewBucketRing(time.Hour, 24)
+
+	tests := []struct {
+		at        string
+		wantStart string
+	}{
+		{at: "2025-07-07T04:29:59Z", wantStart: "2025-07-07T09:00:00+05:30"},
+		{at: "2025-07-07T04:30:00Z", wantStart: "2025-07-07T10:00:00+05:30"},
+		{at: "2025-07-07T05:15:00Z", wantStart: "2025-07-07T10:00:00+05:30"},
+		{at: "2025-07-07T18:29:00Z", wantStart: "2025-07-07T23:00:00+05:30"},
+		{at: "2025-07-07T18:30:00Z", wantStart: "2025-07-08T00:00:00+05:30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.at, func(t *testing.T) {
+			at, _ := time.Parse(time.RFC3339, tt.at)
+			ring.Add(at, true)
+			bucket := ring.Series(at, 1)[0]
+			if got := bucket.Start.Format(time.RFC3339); got != tt.wantStart {
+				t.Errorf("bucket for %s starts at %s, want %s", tt.at, got, tt.wantStart)
+			}
+			if bucket.Requests == 0 {
+				t.Errorf("bucket for %s is empty", tt.at)
+			}
+		})
+	}
+}
+
+func TestRollupsForIST(t *testing.T) {
+	setReportingLocation(t, "Asia/Kolkata")
+	am := &AnalyticsManager{data: &AnalyticsData{Rollups: newRollups()}}
+
+	tests := []struct {
+		at                           string
+		wantDay, wantWeek, wantMonth string
+		wantDayStart, wantWeekStart  string
+	}{
+		// Midnight UTC is 5:30 AM IST, well inside the local day
+		{at: "2025-07-07T00:00:00Z", wantDay: "2025-07-07", wantWeek: "2025-W28", wantMonth: "2025-07",
+			wantDayStart: "2025-07-07T00:00:00+05:30", wantWeekStart: "2025-07-07T00:00:00+05:30"},
+		// Sunday night IST still belongs to the week that started the Monday before
+		{at: "2025-07-06T18:29:59Z", wantDay: "2025-07-06", wantWeek: "2025-W27", wantMonth: "2025-07",
+			wantDayStart: "2025-07-06T00:00:00+05:30", wantWeekStart: "2025-06-30T00:00:00+05:30"},
+		{at: "2025-07-06T18:30:00Z", wantDay: "2025-07-07", wantWeek: "2025-W28", wantMonth: "2025-07",
+			wantDayStart: "2025-07-07T00:00:00+05:30", wantWeekStart: "2025-07-07T00:00:00+05:30"},
+		// New Year's Eve in UTC is already New Year's Day in IST, in ISO week 1 of 2026
+		{at: "2025-12-31T18:29:59Z", wantDay: "2025-12-31", wantWeek: "2026-W01", wantMonth: "2025-12",
+			wantDayStart: "2025-12-31T00:00:00+05:30", wantWeekStart: "2025-12-29T00:00:00+05:30"},
+		{at: "2025-12-31T18:30:00Z", wantDay: "2026-01-01", wantWeek: "2026-W01", wantMonth: "2026-01",
+			wantDayStart: "2026-01-01T00:00:00+05:30", wantWeekStart: "2025-12-29T00:00:00+05:30"},
+		// Early January can still be in the last ISO week of the year before
+		{at: "2021-01-03T12:00:00Z", wantDay: "2021-01-03", wantWeek: "2020-W53", wantMonth: "2021-01",
+			wantDayStart: "2021-01-03T00:00:00+05:30", wantWeekStart: "2020-12-28T00:00:00+05:30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.at, func(t *testing.T) {
+			at, _ := time.Parse(time.RFC3339, tt.at)
+			rollups := am.rollupsFor(at)
+			day, week, month := rollups[0], rollups[1], rollups[2]
+
+			if day.Period != tt.wantDay || week.Period != tt.wantWeek || month.Period != tt.wantMonth {
+				t.Errorf("periods = %s, %s, %s, want %s, %s, %s", day.Period, week.Period, month.Period, tt.wantDay, tt.wantWeek, tt.wantMonth)
+			}
+			if got := day.Start.Format(time.RFC3339); got != tt.wantDayStart {
+				t.Errorf("day starts at %s, want %s", got, tt.wantDayStart)
+			}
+			if got := week.Start.Format(time.RFC3339); got != tt.wantWeekStart {
+				t.Errorf("week starts at %s, want %s", got, tt.wantWeekStart)
+			}
+			if got := month.Start.Format("2006-01-02T15:04:05Z07:00"); got != tt.wantMonth+"-01T00:00:00+05:30" {
+				t.Errorf("month starts at %s", got)
+			}
+		})
+	}
+}
+
+func TestGetRollups(t *testing.T) {
+	setReportingLocation(t, "Asia/Kolkata")
+	am := &AnalyticsManager{data: &AnalyticsData{Rollups: newRollups()}}
+
+	// Two requests on either side of UTC midnight land on the same IST day
+	for _, at := range []string{"2025-07-07T23:00:00Z", "2025-07-08T01:00:00Z", "2025-07-08T19:00:00Z"} {
+		parsed, _ := time.Parse(time.RFC3339, at)
+		am.rollupsFor(parsed)[0].Requests++
+	}
+
+	response, err := am.GetRollups("day", 0)
+	if err != nil {
+		t.Fatalf("GetRollups: %v", err)
+	}
+	if response.Timezone != "Asia/Kolkata" || response.Period != "day" {
+		t.Errorf("response is for %s %s, want Asia/Kolkata day", response.Timezone, response.Period)
+	}
+	var got []string
+	for _, rollup := range response.Rollups {
+		got = append(got, fmt.Sprintf("%s:%d", rollup.Period, rollup.Requests))
+	}
+	if want := []string{"2025-07-09:1", "2025-07-08:2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("daily rollups = %v, want %v", got, want)
+	}
+
+	if response, _ := am.GetRollups("day", 1); len(response.Rollups) != 1 || response.Rollups[0].Period != "2025-07-09" {
+		t.Errorf("limit 1 did not return only the newest rollup")
+	}
+	if _, err := am.GetRollups("fortnight", 0); err == nil {
+		t.Error("GetRollups accepted an unknown period")
+	}
+}
+
+func TestLatencySketchQuantiles(t *testing.T) {
+	sequence := func(n int, f func(i int) int64) []int64 {
+		values := make([]int64, n)
+		for i := range values {
+			values[i] = f(i)
+		}
+		return values
+	}
+
+	tests := []struct {
+		name   string
+		values []int64
+	}{
+		{name: "single value", values: []int64{250}},
+		{name: "zero", values: []int64{0, 0, 0}},
+		{name: "constant", values: sequence(100, func(int) int64 { return 1200 })},
+		{name: "uniform", values: sequence(1000, func(i int) int64 { return int64(i + 1) })},
+		{name: "two clusters", values: sequence(1000, func(i int) int64 {
+			if i%10 == 0 {
+				return 8000
+			}
+			return 40
+		})},
+		{name: "long tail", values: sequence(2000, func(i int) int64 { return int64(math.Exp(float64(i) / 200)) })},
+		{name: "fast cache hits and slow Gemini calls", values: sequence(500, func(i int) int64 { return int64(i%3) * 2750 })},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sketch := &LatencySketch{Buckets: make(map[int]int64)}
+			var sum int64
+			for _, v := range tt.values {
+				sketch.Add(v)
+				sum += v
+			}
+			sorted := append([]int64(nil), tt.values...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			for _, q := range []float64{0, 0.5, 0.95, 0.99, 1} {
+				exact := sorted[int(q*float64(len(sorted)-1))]
+				got := sketch.Quantile(q)
+				// Buckets are relative to ms+1; allow for the relative error plus rounding
+				tolerance := (sketchGamma-1)/(sketchGamma+1)*float64(exact+1) + 1
+				if math.Abs(float64(got-exact)) > tolerance {
+					t.Errorf("Quantile(%v) = %d, want %d within %.1f", q, got, exact, tolerance)
+				}
+			}
+
+			summary := sketch.Summary()
+			if summary.Count != int64(len(tt.values)) {
+				t.Errorf("Summary count = %d, want %d", summary.Count, len(tt.values))
+			}
+			if want := float64(sum) / float64(len(tt.values)); summary.MeanMs != want {
+				t.Errorf("Summary mean = %v, want %v", summary.MeanMs, want)
+			}
+			if summary.P50Ms > summary.P95Ms || summary.P95Ms > summary.P99Ms {
+				t.Errorf("Summary quantiles out of order: %+v", summary)
+			}
+		})
+	}
+}
+
+func TestLatencySketchEdgeCases(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+		q      float64
+		want   int64
+	}{
+		{name: "empty sketch", q: 0.5, want: 0},
+		{name: "negative durations count as zero", values: []int64{-5}, q: 0.5, want: 0},
+		{name: "sub-millisecond", values: []int64{0, 0, 1}, q: 0.5, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sketch := &LatencySketch{Buckets: make(map[int]int64)}
+			for _, v := range tt.values {
+				sketch.Add(v)
+			}
+			if got := sketch.Quantile(tt.q); got != tt.want {
+				t.Errorf("Quantile(%v) = %d, want %d", tt.q, got, tt.want)
+			}
+			if sketch.Count != int64(len(tt.values)) {
+				t.Errorf("Count = %d, want %d", sketch.Count, len(tt.values))
+			}
+		})
+	}
+}
+
+func TestHyperLogLogRegister(t *testing.T) {
+	tests := []struct {
+		name      string
+		hash      uint64
+		wantIndex int
+		wantRank  byte
+	}{
+		{name: "top bits pick the register", hash: 0xABC << 52, wantIndex: 0xABC, wantRank: 53},
+		{name: "first remaining bit set is rank 1", hash: 1 << 51, wantIndex: 0, wantRank: 1},
+		{name: "one leading zero is rank 2", hash: 1 << 50, wantIndex: 0, wantRank: 2},
+		{name: "last bit set", hash: 1, wantIndex: 0, wantRank: 52},
+		{name: "all zeros is capped by the sentinel", hash: 0, wantIndex: 0, wantRank: 53},
+		{name: "all ones", hash: math.MaxUint64, wantIndex: 1<<hllPrecision - 1, wantRank: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, rank := hllRegister(tt.hash)
+			if index != tt.wantIndex || rank != tt.wantRank {
+				t.Errorf("hllRegister(%#x) = %d, %d, want %d, %d", tt.hash, index, rank, tt.wantIndex, tt.wantRank)
+			}
+
+			// Add and AddRegister must agree, and a register only ever grows
+			h := newHyperLogLog()
+			h.Registers[index] = 60
+			h.Add(tt.hash)
+			if h.Registers[index] != 60 {
+				t.Errorf("Add lowered register %d to %d", index, h.Registers[index])
+			}
+			h = newHyperLogLog()
+			h.Add(tt.hash)
+			if h.Registers[index] != tt.wantRank {
+				t.Errorf("Add set register %d to %d, want %d", index, h.Registers[index], tt.wantRank)
+			}
+		})
+	}
+
+	t.Run("out of range registers are ignored", func(t *testing.T) {
+		h := newHyperLogLog()
+		h.AddRegister(-1, 5)
+		h.AddRegister(len(h.Registers), 5)
+		if got := h.Estimate(); got != 0 {
+			t.Errorf("Estimate = %d after out of range adds, want 0", got)
+		}
+	})
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	key := []byte("test sketch key")
+
+	tests := []struct {
+		distinct int
+		repeats  int
+	}{
+		{distinct: 0, repeats: 1},
+		{distinct: 1, repeats: 5},
+		{distinct: 10, repeats: 1},
+		{distinct: 100, repeats: 3},
+		{distinct: 1000, repeats: 1},
+		{distinct: 10000, repeats: 2},
+		{distinct: 100000, repeats: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d distinct", tt.distinct), func(t *testing.T) {
+			h := newHyperLogLog()
+			for r := 0; r < tt.repeats; r++ {
+				for i := 0; i < tt.distinct; i++ {
+					h.Add(keyedHash(key, fmt.Sprintf("203.0.113.%d", i)))
+				}
+			}
+
+			// About 1.6% standard error; three of them is plenty for a fixed key
+			got := h.Estimate()
+			tolerance := 0.05*float64(tt.distinct) + 1
+			if math.Abs(float64(got)-float64(tt.distinct)) > tolerance {
+				t.Errorf("Estimate = %d, want %d within %.0f", got, tt.distinct, tolerance)
+			}
+		})
+	}
+}
+
+// useTestAnonymizer swaps in an anonymizer with a fresh salt for one test
+func useTestAnonymizer(t *testing.T) *Anonymizer {
+	t.Helper()
+	previous := anonymizer
+	anonymizer = NewAnonymizer(filepath.Join(t.TempDir(), "visitor-salt.json"), 0)
+	t.Cleanup(func() { anonymizer = previous })
+	return anonymizer
+}
+
+func TestAnonymizerHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "visitor-salt.json")
+	a := NewAnonymizer(path, 0)
+
+	hash := a.Hash("203.0.113.7")
+	if hash != a.Hash("203.0.113.7") {
+		t.Error("Hash is not stable within a period")
+	}
+	if hash == a.Hash("203.0.113.8") {
+		t.Error("different IPs hash the same")
+	}
+	if got, want := a.Key("203.0.113.7"), strconv.FormatUint(hash, 16); got != want {
+		t.Errorf("Key = %q, want %q", got, want)
+	}
+
+	// The salt survives a restart but isn't shared with other installs
+	if got := NewAnonymizer(path, 0).Hash("203.0.113.7"); got != hash {
+		t.Errorf("after reload, Hash = %x, want %x", got, hash)
+	}
+	if other := NewAnonymizer(filepath.Join(t.TempDir(), "visitor-salt.json"), 0); other.Hash("203.0.113.7") == hash {
+		t.Error("a fresh salt produced the same hash")
+	}
+}
+
+func TestAnonymizerKeepsRetiredSalts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "visitor-salt.json")
+	a := NewAnonymizer(path, 0)
+	before := a.Hash("user-1")
+
+	// Pretend the current period started a rotation ago so the next hash rotates the salt
+	a.mutex.Lock()
+	a.period = a.period.Add(-a.rotation)
+	a.mutex.Unlock()
+	after := a.Hash("user-1")
+	if after == before {
+		t.Fatal("the salt did not rotate")
+	}
+
+	hashes := NewAnonymizer(path, 0).Hashes("user-1")
+	if len(hashes) != 2 || !hashes[before] || !hashes[after] {
+		t.Errorf("Hashes after reload = %v, want %x and %x", hashes, before, after)
+	}
+}
+
+func TestPrivacyModeSkipsVisitors(t *testing.T) {
+	t.Setenv("ANALYTICS_PRIVACY_MODE", "true")
+	am := useTestAnalytics(t)
+	if !useTestAnonymizer(t).PrivacyMode() {
+		t.Fatal("ANALYTICS_PRIVACY_MODE=true did not enable privacy mode")
+	}
+
+	am.TrackPageVisit("203.0.113.7", "user-1")
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	if visits := am.data.UserMetrics.TotalPageVisits; visits != 1 {
+		t.Errorf("TotalPageVisits = %d, want 1", visits)
+	}
+	if unique := am.data.UserMetrics.UniqueUsers; unique != 0 {
+		t.Errorf("UniqueUsers = %d in privacy mode, want 0", unique)
+	}
+}
+
+func TestPurgeVisitor(t *testing.T) {
+	am := useTestAnalytics(t)
+	a := useTestAnonymizer(t)
+
+	visits := []struct{ ip, userID string }{
+		{"203.0.113.7", "user-1"},
+		{"198.51.100.1", "user-2"},
+		{"203.0.113.7", ""},
+		{"192.0.2.5", "user-1"},
+		{"198.51.100.1", ""},
+	}
+	for _, visit := range visits {
+		am.TrackPageVisit(visit.ip, visit.userID)
+	}
+
+	// Visits are only tied to the user ID; the IP alone finds nothing
+	removed, err := am.PurgeVisitor(a.Hashes("user-1"))
+	if err != nil {
+		t.Fatalf("PurgeVisitor: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("purging user-1 removed %d events, want 2", removed)
+	}
+	if removed, _ := am.PurgeVisitor(a.Hashes("203.0.113.7")); removed != 0 {
+		t.Errorf("purging 203.0.113.7 removed %d events, want 0", removed)
+	}
+	if removed, _ := am.PurgeVisitor(a.Hashes("user-2")); removed != 1 {
+		t.Errorf("purging user-2 removed %d events, want 1", removed)
+	}
+}
+
+func TestEventLogRewrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxBytes    int64
+		batches     [][]int64
+		drop        uint64 // visitor hash to drop; events get seq % 3
+		wantDropped int
+		want        []int64
+	}{
+		{name: "single file", maxBytes: 1 << 20, batches: [][]int64{{1, 2, 3, 4, 5, 6}}, drop: 1, wantDropped: 2, want: []int64{2, 3, 5, 6}},
+		{name: "rotated files", maxBytes: 1, batches: [][]int64{{1, 2}, {3, 4}, {5, 6}}, drop: 2, wantDropped: 2, want: []int64{1, 3, 4, 6}},
+		{name: "nothing matches", maxBytes: 1, batches: [][]int64{{3}, {6}}, drop: 1, want: []int64{3, 6}},
+		{name: "whole file dropped", maxBytes: 1, batches: [][]int64{{1}, {2}, {3}}, drop: 1, wantDropped: 1, want: []int64{2, 3}},
+		{name: "empty log", maxBytes: 1, drop: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			eventLog := writeEventBatches(t, dir, tt.maxBytes, tt.batches)
+			defer eventLog.Close()
+
+			dropped, err := eventLog.Rewrite(func(e AnalyticsEvent) bool { return e.UserHash != tt.drop })
+			if err != nil {
+				t.Fatalf("Rewrite: %v", err)
+			}
+			if dropped != tt.wantDropped {
+				t.Errorf("Rewrite dropped %d events, want %d", dropped, tt.wantDropped)
+			}
+			if got := replaySeqs(t, eventLog, 0); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("after Rewrite, Replay = %v, want %v", got, tt.want)
+			}
+
+			// Appends after a rewrite reopen the current file and are replayed too
+			if err := eventLog.Append([]AnalyticsEvent{{Seq: 100, Type: eventPageVisit}}); err != nil {
+				t.Fatalf("Append after Rewrite: %v", err)
+			}
+			if got := replaySeqs(t, eventLog, 0); len(got) == 0 || got[len(got)-1] != 100 {
+				t.Errorf("after Append, Replay = %v, want it to end with 100", got)
+			}
+		})
+	}
+}
+
+// writeAPIKeysFile points API_KEYS_FILE at a file holding keys for one test
+func writeAPIKeysFile(t *testing.T, keys string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api-keys.json")
+	if err := os.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("API_KEYS_FILE", path)
+}
+
+func TestNewAuthenticatorRejectsBadKeys(t *testing.T) {
+	for name, keys := range map[string]string{
+		"unknown scope":  `[{"name": "ops", "key": "k1", "scopes": ["write-analytics"]}]`,
+		"missing key":    `[{"name": "ops", "scopes": ["admin"]}]`,
+		"missing name":   `[{"key": "k1", "scopes": ["admin"]}]`,
+		"duplicate name": `[{"name": "ops", "key": "k1"}, {"name": "ops", "key": "k2"}]`,
+		"not a list":     `{"name": "ops", "key": "k1"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeAPIKeysFile(t, keys)
+			if _, err := NewAuthenticator(); err == nil {
+				t.Errorf("NewAuthenticator accepted %s", keys)
+			}
+		})
+	}
+
+	t.Run("env key clashing with a file key", func(t *testing.T) {
+		writeAPIKeysFile(t, `[{"name": "admin", "key": "k1", "scopes": ["admin"]}]`)
+		t.Setenv("ADMIN_API_KEY", "k2")
+		if _, err := NewAuthenticator(); err == nil {
+			t.Error("NewAuthenticator accepted two keys named admin")
+		}
+	})
+}
+
+func TestAuthHandler(t *testing.T) {
+	useTestAnonymizer(t)
+	writeAPIKeysFile(t, `[{"name": "ops", "key": "ops-key", "scopes": ["admin"]}]`)
+	t.Setenv("ANALYTICS_API_KEY", "reader-key")
+	t.Setenv("ADMIN_API_KEY", "admin-key")
+	auth, err := NewAuthenticator()
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	previous := authenticator
+	authenticator = auth
+	t.Cleanup(func() { authenticator = previous })
+
+	tests := []struct {
+		name       string
+		scope      string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "no key", scope: scopeReadAnalytics, wantStatus: http.StatusUnauthorized},
+		{name: "wrong key", scope: scopeReadAnalytics, header: "Authorization", value: "Bearer reader-kee", wantStatus: http.StatusUnauthorized},
+		{name: "key without the bearer prefix", scope: scopeReadAnalytics, header: "Authorization", value: "reader-key", wantStatus: http.StatusUnauthorized},
+		{name: "reader reads", scope: scopeReadAnalytics, header: "Authorization", value: "Bearer reader-key", wantStatus: http.StatusOK},
+		{name: "reader via X-API-Key", scope: scopeReadAnalytics, header: "X-API-Key", value: "reader-key", wantStatus: http.StatusOK},
+		{name: "reader can't purge", scope: scopeAdmin, header: "Authorization", value: "Bearer reader-key", wantStatus: http.StatusForbidden},
+		{name: "admin key has both scopes", scope: scopeReadAnalytics, header: "X-API-Key", value: "admin-key", wantStatus: http.StatusOK},
+		{name: "admin purges", scope: scopeAdmin, header: "Authorization", value: "Bearer admin-key", wantStatus: http.StatusOK},
+		{name: "scopes are not implied", scope: scopeReadAnalytics, header: "X-API-Key", value: "ops-key", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := authHandler(tt.scope, func(w http.ResponseWriter, r *http.Request) { called = true })
+
+			req := httptest.NewRequest(http.MethodGet, "/analytics", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("next called = %v with status %d", called, rec.Code)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestParseWindowDays(t *testing.T) {
+	tests := []struct {
+		window  string
+		want    int
+		wantErr bool
+	}{
+		{window: "all", want: 0},
+		{window: "1d", want: 1},
+		{window: "7d", want: 7},
+		{window: "24h", want: 1},
+		{window: "25h", want: 2},
+		{window: "90m", want: 1},
+		{window: "0d", wantErr: true},
+		{window: "-2h", wantErr: true},
+		{window: "week", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseWindowDays(tt.window)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseWindowDays(%q) = %d, %v, want %d (error %v)", tt.window, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// recordPortfolios applies portfolio events directly, so they can be dated in the past
+func recordPortfolios(am *AnalyticsManager, events []AnalyticsEvent) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	for _, event := range events {
+		event.Type = eventPortfolio
+		am.apply(&event)
+	}
+}
+
+func TestPopularityWindows(t *testing.T) {
+	setReportingLocation(t, "Asia/Kolkata")
+	am := useTestAnalytics(t)
+
+	score := func(s int) *int { return &s }
+	now := time.Now()
+	recordPortfolios(am, []AnalyticsEvent{
+		{Time: now, Tickers: []string{"TCS", "INFY", "WIPRO"}, Score: score(42), Fallbacks: []string{"WIPRO"}},
+		{Time: now, Tickers: []string{"INFY", "TCS"}, Score: score(100)},
+		{Time: now.AddDate(0, 0, -1), Tickers: []string{"ZOMATO", "TCS"}, Score: score(7)},
+		{Time: now.AddDate(0, 0, -10), Tickers: []string{"YESBANK", "ZOMATO"}, Score: score(3)},
+	})
+
+	tickers, err := am.GetTopTickers("7d", 2)
+	if err != nil {
+		t.Fatalf("GetTopTickers: %v", err)
+	}
+	if tickers.Portfolios != 3 || tickers.Timezone != "Asia/Kolkata" {
+		t.Errorf("7d covers %d portfolios in %s, want 3 in Asia/Kolkata", tickers.Portfolios, tickers.Timezone)
+	}
+	if want := now.In(reportingLocation).AddDate(0, 0, -6).Format("2006-01-02"); tickers.From != want {
+		t.Errorf("7d starts from %s, want %s", tickers.From, want)
+	}
+	wantTickers := []TickerPopularity{
+		{Ticker: "TCS", Count: 3, Share: 1},
+		{Ticker: "INFY", Count: 2, Share: 2.0 / 3},
+	}
+	if !reflect.DeepEqual(tickers.Tickers, wantTickers) {
+		t.Errorf("top tickers = %+v, want %+v", tickers.Tickers, wantTickers)
+	}
+	if want := map[int]int64{2: 2, 3: 1}; !reflect.DeepEqual(tickers.PortfolioSizes, want) {
+		t.Errorf("portfolio sizes = %v, want %v", tickers.PortfolioSizes, want)
+	}
+
+	// Fallbacks are counted per ticker
+	all, _ := am.GetTopTickers("all", 0)
+	for _, ticker := range all.Tickers {
+		if ticker.Ticker == "WIPRO" && (ticker.Fallbacks != 1 || ticker.FallbackRate != 1) {
+			t.Errorf("WIPRO = %+v, want its one analysis counted as a fallback", ticker)
+		}
+	}
+
+	for window, want := range map[string][]TickerPair{
+		"1d": {
+			{Tickers: [2]string{"INFY", "TCS"}, Count: 2},
+			{Tickers: [2]string{"INFY", "WIPRO"}, Count: 1},
+			{Tickers: [2]string{"TCS", "WIPRO"}, Count: 1},
+		},
+		"48h": {
+			{Tickers: [2]string{"INFY", "TCS"}, Count: 2},
+			{Tickers: [2]string{"INFY", "WIPRO"}, Count: 1},
+			{Tickers: [2]string{"TCS", "WIPRO"}, Count: 1},
+			{Tickers: [2]string{"TCS", "ZOMATO"}, Count: 1},
+		},
+		"all": {
+			{Tickers: [2]string{"INFY", "TCS"}, Count: 2},
+			{Tickers: [2]string{"INFY", "WIPRO"}, Count: 1},
+			{Tickers: [2]string{"TCS", "WIPRO"}, Count: 1},
+			{Tickers: [2]string{"TCS", "ZOMATO"}, Count: 1},
+			{Tickers: [2]string{"YESBANK", "ZOMATO"}, Count: 1},
+		},
+	} {
+		pairs, err := am.GetTopPairs(window, 0)
+		if err != nil {
+			t.Fatalf("GetTopPairs(%s): %v", window, err)
+		}
+		if !reflect.DeepEqual(pairs.Pairs, want) {
+			t.Errorf("pairs over %s = %v, want %v", window, pairs.Pairs, want)
+		}
+	}
+
+	scores, err := am.GetScoreHistogram("7d")
+	if err != nil {
+		t.Fatalf("GetScoreHistogram: %v", err)
+	}
+	counts := make([]int64, len(scores.Histogram))
+	for i, bucket := range scores.Histogram {
+		counts[i] = bucket.Count
+	}
+	if want := []int64{1, 0, 0, 0, 1, 0, 0, 0, 0, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("histogram = %v, want %v", counts, want)
+	}
+	if scores.Histogram[9].Max != 100 || scores.Count != 3 || math.Abs(scores.Mean-149.0/3) > 1e-9 {
+		t.Errorf("scores = %+v, want 3 scores averaging 49.67 with 100 in the top bucket", scores)
+	}
+
+	if _, err := am.GetScoreHistogram("soon"); err == nil {
+		t.Error("GetScoreHistogram accepted an invalid window")
+	}
+}
+
+func TestTrackPortfolio(t *testing.T) {
+	am := useTestAnalytics(t)
+	am.TrackPortfolio([]string{"TCS", "INFY"}, 61, &ResponseMeta{
+		Fallbacks: []FallbackInfo{{Section: "stock:INFY", Reason: "upstream_error"}},
+	})
+
+	tickers, _ := am.GetTopTickers("1d", 0)
+	want := []TickerPopularity{
+		{Ticker: "INFY", Count: 1, Share: 1, Fallbacks: 1, FallbackRate: 1},
+		{Ticker: "TCS", Count: 1, Share: 1},
+	}
+	if !reflect.DeepEqual(tickers.Tickers, want) {
+		t.Errorf("tickers = %+v, want %+v", tickers.Tickers, want)
+	}
+	if scores, _ := am.GetScoreHistogram("1d"); scores.Count != 1 || scores.Histogram[6].Count != 1 {
+		t.Errorf("score 61 was not counted in the 60-69 bucket: %+v", scores.Histogram)
+	}
+
+	// A fallback score still counts the portfolio but stays out of the histogram
+	am.TrackPortfolio([]string{"TCS"}, 53, &ResponseMeta{
+		Fallbacks: []FallbackInfo{{Section: "score", Reason: "upstream_error"}},
+	})
+	if tickers, _ := am.GetTopTickers("1d", 0); tickers.Portfolios != 2 {
+		t.Errorf("portfolios = %d, want 2", tickers.Portfolios)
+	}
+	if scores, _ := am.GetScoreHistogram("1d"); scores.Count != 1 || scores.Histogram[5].Count != 0 {
+		t.Errorf("fallback score 53 was counted: %+v", scores.Histogram)
+	}
+}